@@ -0,0 +1,196 @@
+// Copyright (c) 2020 The Jaeger Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tlscfg
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+
+	"go.uber.org/zap"
+)
+
+// cacheWatchRetryInterval is how often watchChangesLoop retries constructing
+// the cache watcher after a cold start, i.e. before autocert.Manager has
+// written anything to ACMECacheDir yet.
+const cacheWatchRetryInterval = time.Second
+
+// acmeCertSource obtains and renews a server TLS certificate automatically
+// via ACME (e.g. Let's Encrypt) instead of requiring a pre-provisioned
+// CertPath/KeyPath. It implements the same certificate()/Close() contract as
+// certWatcher so that ServerConfig can use either interchangeably.
+//
+// Issuance itself is never triggered by acmeCertSource: ServerConfig.Config
+// wires manager.GetCertificate directly as tls.Config.GetCertificate, and
+// it's the first real TLS handshake against the running listener that makes
+// autocert actually obtain a certificate (and, for TLS-ALPN-01, answer the
+// CA's validation probe). acmeCertSource only watches ACMECacheDir for the
+// result, so CertificateInfo() has something to report.
+type acmeCertSource struct {
+	manager   *autocert.Manager
+	logger    *zap.Logger
+	host      string
+	cacheFile string
+
+	stop      chan struct{}
+	closeOnce sync.Once
+
+	mu           sync.RWMutex
+	cacheWatcher *certWatcher
+	cert         *tls.Certificate
+}
+
+// newACMECertSource builds an acmeCertSource from opts. opts.ACMEHostWhitelist
+// must contain at least one hostname, and opts.ACMECacheDir must be set.
+func newACMECertSource(opts Options, logger *zap.Logger) (*acmeCertSource, error) {
+	if len(opts.ACMEHostWhitelist) == 0 {
+		return nil, errors.New("ACMEHostWhitelist must list at least one hostname")
+	}
+	if opts.ACMECacheDir == "" {
+		return nil, errors.New("ACMECacheDir must be set")
+	}
+
+	manager := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Cache:      autocert.DirCache(opts.ACMECacheDir),
+		HostPolicy: autocert.HostWhitelist(opts.ACMEHostWhitelist...),
+		Email:      opts.ACMEEmail,
+	}
+	if opts.ACMEDirectoryURL != "" {
+		manager.Client = &acme.Client{DirectoryURL: opts.ACMEDirectoryURL}
+	}
+
+	host := opts.ACMEHostWhitelist[0]
+	a := &acmeCertSource{
+		manager: manager,
+		logger:  logger,
+		host:    host,
+		// autocert.DirCache stores the leaf certificate for host
+		// "example.com" as "example.com" (PEM, cert+key concatenated) in the
+		// cache directory. Watching that single file is enough to detect
+		// renewals performed by this process or a sibling process sharing
+		// the same ACMECacheDir.
+		cacheFile: filepath.Join(opts.ACMECacheDir, host),
+		stop:      make(chan struct{}),
+	}
+
+	// The cache file won't exist yet on a cold start: nothing has requested
+	// a certificate from this host before, so there's nothing to seed
+	// a.cert with or watch. watchChangesLoop retries until the first
+	// issuance (triggered by a real handshake, not by this constructor)
+	// creates it.
+	if cacheWatcher, err := newCertWatcher(Options{CertPath: a.cacheFile, KeyPath: a.cacheFile}, logger); err == nil {
+		a.cacheWatcher = cacheWatcher
+		a.cert = cacheWatcher.certificate()
+	} else if !os.IsNotExist(err) {
+		logger.Warn("Failed to watch ACME certificate cache for sibling renewals",
+			zap.String("certificate", a.cacheFile), zap.Error(err))
+	}
+
+	return a, nil
+}
+
+// watchChangesLoop keeps a.cert in sync with the cache watcher's leaf
+// certificate, whether it's reloaded because this process renewed it (via
+// manager.GetCertificate's own background renewal) or because a sibling
+// process sharing ACMECacheDir did. If the cache file didn't exist yet when
+// newACMECertSource ran, it's retried periodically until the first issuance
+// creates it. It runs until Close is called.
+func (a *acmeCertSource) watchChangesLoop() {
+	for a.getCacheWatcher() == nil {
+		select {
+		case <-a.stop:
+			return
+		case <-time.After(cacheWatchRetryInterval):
+		}
+		if cacheWatcher, err := newCertWatcher(Options{CertPath: a.cacheFile, KeyPath: a.cacheFile}, a.logger); err == nil {
+			a.setCacheWatcher(cacheWatcher)
+		}
+	}
+
+	cacheWatcher := a.getCacheWatcher()
+	events, cancel := cacheWatcher.Subscribe(func(e Event) bool { return e.Type == CertReloaded })
+	defer cancel()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for e := range events {
+			a.mu.Lock()
+			a.cert = e.Cert
+			a.mu.Unlock()
+		}
+	}()
+
+	cacheWatcher.run()
+	cancel()
+	<-done
+}
+
+// getCacheWatcher returns the cache watcher, or nil if the cache file hasn't
+// appeared yet.
+func (a *acmeCertSource) getCacheWatcher() *certWatcher {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.cacheWatcher
+}
+
+// setCacheWatcher records a newly constructed cache watcher and seeds a.cert
+// from the certificate it loaded.
+func (a *acmeCertSource) setCacheWatcher(w *certWatcher) {
+	a.mu.Lock()
+	a.cacheWatcher = w
+	a.cert = w.certificate()
+	a.mu.Unlock()
+}
+
+// CertificateInfo returns metadata about the ACME-managed certificate, keyed
+// by hostname, if one has been obtained yet.
+func (a *acmeCertSource) CertificateInfo() map[string]CertificateInfo {
+	cert := a.certificate()
+	if cert == nil {
+		return nil
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil
+	}
+	return map[string]CertificateInfo{a.host: newCertificateInfo(a.host, leaf)}
+}
+
+// certificate returns the most recently obtained or renewed certificate, or
+// nil if none has been issued yet.
+func (a *acmeCertSource) certificate() *tls.Certificate {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.cert
+}
+
+// Close stops watchChangesLoop and releases the cache watcher's resources,
+// if one was ever constructed.
+func (a *acmeCertSource) Close() error {
+	a.closeOnce.Do(func() { close(a.stop) })
+	if cacheWatcher := a.getCacheWatcher(); cacheWatcher != nil {
+		return cacheWatcher.Close()
+	}
+	return nil
+}
@@ -0,0 +1,135 @@
+// Copyright (c) 2020 The Jaeger Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tlscfg
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// writeACMECacheEntry writes a PEM blob shaped the way autocert.DirCache
+// stores a host's leaf certificate: the certificate followed by its private
+// key in a single file, which is what lets newCertWatcher load it via
+// CertPath == KeyPath == that file.
+func writeACMECacheEntry(t *testing.T, dir, host, commonName string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		DNSNames:     []string{host},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	require.NoError(t, err)
+
+	var blob []byte
+	blob = append(blob, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	blob = append(blob, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})...)
+
+	require.NoError(t, syncWrite(filepath.Join(dir, host), blob, 0o644))
+}
+
+func TestNewACMECertSource_validation(t *testing.T) {
+	_, err := newACMECertSource(Options{ACMECacheDir: t.TempDir()}, zap.NewNop())
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "ACMEHostWhitelist")
+
+	_, err = newACMECertSource(Options{ACMEHostWhitelist: []string{"example.com"}}, zap.NewNop())
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "ACMECacheDir")
+}
+
+func TestNewACMECertSource_seedsFromExistingCache(t *testing.T) {
+	cacheDir := t.TempDir()
+	writeACMECacheEntry(t, cacheDir, "example.com", "cached-leaf")
+
+	a, err := newACMECertSource(Options{
+		ACMEHostWhitelist: []string{"example.com"},
+		ACMECacheDir:      cacheDir,
+	}, zap.NewNop())
+	require.NoError(t, err)
+	defer a.Close()
+
+	info := a.CertificateInfo()
+	require.Contains(t, info, "example.com")
+	assert.Equal(t, "CN=cached-leaf", info["example.com"].Subject)
+}
+
+func TestACMECertSource_watchChangesLoop_picksUpFirstIssuance(t *testing.T) {
+	cacheDir := t.TempDir()
+
+	a, err := newACMECertSource(Options{
+		ACMEHostWhitelist: []string{"example.com"},
+		ACMECacheDir:      cacheDir,
+	}, zap.NewNop())
+	require.NoError(t, err)
+	defer a.Close()
+
+	// Cold start: nothing has been issued yet, so there's nothing to report.
+	assert.Nil(t, a.CertificateInfo())
+
+	go a.watchChangesLoop()
+
+	// Simulate the real listener's first handshake causing autocert to
+	// obtain and cache a certificate.
+	writeACMECacheEntry(t, cacheDir, "example.com", "issued-leaf")
+
+	waitUntil(func() bool {
+		return a.CertificateInfo() != nil
+	}, 100, 100*time.Millisecond)
+
+	info := a.CertificateInfo()
+	require.Contains(t, info, "example.com")
+	assert.Equal(t, "CN=issued-leaf", info["example.com"].Subject)
+}
+
+func TestACMECertSource_Close_noCacheWatcher(t *testing.T) {
+	a, err := newACMECertSource(Options{
+		ACMEHostWhitelist: []string{"example.com"},
+		ACMECacheDir:      t.TempDir(),
+	}, zap.NewNop())
+	require.NoError(t, err)
+	assert.NoError(t, a.Close())
+}
+
+func TestACMECertSource_CertificateInfo_noCertYet(t *testing.T) {
+	a, err := newACMECertSource(Options{
+		ACMEHostWhitelist: []string{"example.com"},
+		ACMECacheDir:      t.TempDir(),
+	}, zap.NewNop())
+	require.NoError(t, err)
+	defer a.Close()
+	assert.Nil(t, a.CertificateInfo())
+}
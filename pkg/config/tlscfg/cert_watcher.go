@@ -0,0 +1,732 @@
+// Copyright (c) 2020 The Jaeger Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tlscfg
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"go.uber.org/zap"
+
+	"github.com/jaegertracing/jaeger/pkg/metrics"
+)
+
+var errNoValidCertsInPEM = errors.New("no valid certificates found")
+
+// EventType identifies what kind of reload a certWatcher Event describes.
+type EventType int
+
+const (
+	// CertReloaded is published when the server/client leaf certificate
+	// (CertPath/KeyPath) is successfully (re)loaded. Event.Cert is set.
+	CertReloaded EventType = iota
+	// CAReloaded is published when the CA certificate (CAPath) is
+	// successfully (re)loaded. Event.Pool is set.
+	CAReloaded
+	// ClientCAReloaded is published when the client CA certificate
+	// (ClientCAPath) is successfully (re)loaded. Event.Pool is set.
+	ClientCAReloaded
+	// LoadFailed is published when any of the above fails to load, e.g.
+	// because the file on disk doesn't parse. Event.Path identifies which
+	// configured path failed and Event.Err carries the cause. The last
+	// known good certificate/pool, if any, remains in effect.
+	LoadFailed
+)
+
+// Event describes a single reload outcome published by certWatcher to its
+// subscribers.
+type Event struct {
+	Type EventType
+	Path string
+	Cert *tls.Certificate
+	Pool *x509.CertPool
+	Err  error
+
+	// pem holds the raw bytes backing Pool for CAReloaded/ClientCAReloaded
+	// events from CAPath/ClientCAPath; it is nil for events from a bundle
+	// directory. It isn't exported because x509.CertPool can't be merged into
+	// another pool directly; it exists so that watchChangesLoop can keep
+	// feeding a caller-owned shared pool on top of the subscription
+	// mechanism, for backward compatibility.
+	pem []byte
+}
+
+// CancelFunc unsubscribes a previously created subscription and closes its
+// event channel. It is safe to call more than once.
+type CancelFunc func()
+
+// certWatcher watches the filesystem paths referenced by Options (the
+// server/client leaf certificate, the CA and the client CA) and reloads them
+// in place whenever they change on disk, so long running TLS servers and
+// clients pick up rotated material without requiring a process restart.
+// Subscribe lets multiple independent consumers react to reloads without
+// sharing mutable state; watchChangesLoop is a backward-compatible wrapper
+// that mutates a shared pair of certificate pools instead.
+//
+// A certWatcher must be started by running watchChangesLoop (or by draining
+// a Subscribe channel and calling run directly), typically in its own
+// goroutine, and stopped with Close.
+type certWatcher struct {
+	watcher *fsnotify.Watcher
+	opts    Options
+	logger  *zap.Logger
+
+	mu   sync.RWMutex
+	cert *tls.Certificate
+
+	// lastRead* hold the raw PEM bytes observed on the previous pass, even
+	// when that pass failed to parse, so that the reload loop can tell
+	// which file actually changed and avoid reprocessing unchanged ones.
+	// lastReadCert/Key/Passphrase are only ever touched from the run()
+	// goroutine. lastReadCA is also read by the OCSP refresh goroutine
+	// (findOCSPIssuer, via caBundle), so it and lastReadClientCA are guarded
+	// by caMu.
+	lastReadCert       []byte
+	lastReadKey        []byte
+	lastReadPassphrase []byte
+
+	caMu             sync.RWMutex
+	lastReadCA       []byte
+	lastReadClientCA []byte
+
+	subMu       sync.Mutex
+	nextSubID   int
+	subscribers map[int]*subscription
+
+	// metrics, if non-nil (set via withMetrics), receives expiration
+	// telemetry for every certificate this watcher loads.
+	metrics metrics.Factory
+
+	infoMu   sync.RWMutex
+	certInfo map[string]CertificateInfo
+
+	expiryCheckStop chan struct{}
+
+	// poolMu guards caBundlePool/clientCABundlePool and their matching
+	// content hashes, which are replaced wholesale on every reload (rather
+	// than mutated in place, like lastReadCA/lastReadClientCA's pools) so
+	// that a root falling out of the bundle directory is actually dropped,
+	// not just never removed. The hashes let reloadCABundleDir skip the
+	// rebuild/publish/log when a fsnotify wakeup wasn't actually caused by a
+	// change under the bundle directory, the same way pemChanged does for
+	// the single-file CA paths.
+	poolMu                     sync.RWMutex
+	caBundlePool               *x509.CertPool
+	clientCABundlePool         *x509.CertPool
+	lastReadCABundleHash       [sha256.Size]byte
+	lastReadClientCABundleHash [sha256.Size]byte
+
+	// ocspMu guards ocspNextUpdate, which is only ever read/written from the
+	// OCSP refresh goroutine plus ocspRefreshInterval, kept separate from mu
+	// since it tracks the staple's metadata rather than the certificate
+	// itself.
+	ocspMu         sync.RWMutex
+	ocspNextUpdate time.Time
+	ocspStop       chan struct{}
+}
+
+type subscription struct {
+	filter func(Event) bool
+	ch     chan Event
+}
+
+const subscriberBufferSize = 8
+
+// newCertWatcher creates a certWatcher and performs the initial load of the
+// configured certificate, CA and client CA files. The returned watcher must
+// have watchChangesLoop run on it to react to subsequent filesystem changes,
+// and Close must be called to release the underlying fsnotify watcher.
+func newCertWatcher(opts Options, logger *zap.Logger) (*certWatcher, error) {
+	if opts.CAPath != "" && opts.CABundleDir != "" {
+		return nil, errors.New("CAPath and CABundleDir are mutually exclusive")
+	}
+	if opts.ClientCAPath != "" && opts.ClientCABundleDir != "" {
+		return nil, errors.New("ClientCAPath and ClientCABundleDir are mutually exclusive")
+	}
+
+	fsWatcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+
+	w := &certWatcher{
+		watcher:     fsWatcher,
+		opts:        opts,
+		logger:      logger,
+		subscribers: make(map[int]*subscription),
+	}
+
+	if err := w.addWatches(fsWatcher, opts); err != nil {
+		fsWatcher.Close()
+		return nil, err
+	}
+
+	if opts.CAPath != "" {
+		data, err := os.ReadFile(opts.CAPath)
+		if err != nil {
+			fsWatcher.Close()
+			return nil, fmt.Errorf("failed to read CA certificate: %w", err)
+		}
+		w.lastReadCA = data
+		w.recordCAFile(opts.CAPath, data)
+	}
+
+	if opts.ClientCAPath != "" {
+		data, err := os.ReadFile(opts.ClientCAPath)
+		if err != nil {
+			fsWatcher.Close()
+			return nil, fmt.Errorf("failed to read client CA certificate: %w", err)
+		}
+		w.lastReadClientCA = data
+		w.recordCAFile(opts.ClientCAPath, data)
+	}
+
+	if opts.KeyPassphraseFile != "" {
+		data, err := os.ReadFile(opts.KeyPassphraseFile)
+		if err != nil {
+			fsWatcher.Close()
+			return nil, fmt.Errorf("failed to read key passphrase: %w", err)
+		}
+		w.lastReadPassphrase = data
+	}
+
+	if opts.CABundleDir != "" {
+		pool, hash, err := w.loadCABundleDir(opts.CABundleDir)
+		if err != nil {
+			fsWatcher.Close()
+			return nil, fmt.Errorf("failed to load CA bundle directory: %w", err)
+		}
+		w.caBundlePool = pool
+		w.lastReadCABundleHash = hash
+	}
+
+	if opts.ClientCABundleDir != "" {
+		pool, hash, err := w.loadCABundleDir(opts.ClientCABundleDir)
+		if err != nil {
+			fsWatcher.Close()
+			return nil, fmt.Errorf("failed to load client CA bundle directory: %w", err)
+		}
+		w.clientCABundlePool = pool
+		w.lastReadClientCABundleHash = hash
+	}
+
+	if opts.CertPath != "" && opts.KeyPath != "" {
+		certData, keyData, cert, err := loadCertificate(opts.CertPath, opts.KeyPath, opts)
+		if err != nil {
+			fsWatcher.Close()
+			if keyErr := (*keyDecryptError)(nil); errors.As(err, &keyErr) {
+				return nil, fmt.Errorf("failed to decrypt private key: %w", err)
+			}
+			return nil, fmt.Errorf("failed to load server TLS cert and key: %w", err)
+		}
+		w.cert = cert
+		w.lastReadCert = certData
+		w.lastReadKey = keyData
+		if leaf, err := x509.ParseCertificate(cert.Certificate[0]); err == nil {
+			w.recordCertificate(opts.CertPath, leaf)
+		}
+	}
+
+	return w, nil
+}
+
+// loadCertificate reads and parses the cert/key pair, transparently
+// decrypting KeyPath first if it holds an encrypted private key. The
+// returned keyData is always the raw bytes read from disk (possibly still
+// encrypted), since that's what's used to detect future changes; the
+// decrypted key is only ever held in memory for the duration of this call.
+func loadCertificate(certPath, keyPath string, opts Options) (certData, keyData []byte, cert *tls.Certificate, err error) {
+	certData, err = os.ReadFile(certPath)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	keyData, err = os.ReadFile(keyPath)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	decryptedKey, err := decryptKeyIfNeeded(keyData, opts)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	c, err := tls.X509KeyPair(certData, decryptedKey)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return certData, keyData, &c, nil
+}
+
+// addWatches registers an fsnotify watch on the parent directory of every
+// non-empty file path in opts, and on CABundleDir/ClientCABundleDir
+// themselves (see addBundleDirWatches). Watching the directory rather than the file itself
+// means the watcher also observes the atomic renames used by e.g.
+// Kubernetes projected secret volumes, where the file is actually a symlink
+// that gets repointed at a new target directory.
+func (*certWatcher) addWatches(watcher *fsnotify.Watcher, opts Options) error {
+	watchedDirs := make(map[string]bool)
+	for _, path := range []string{opts.CAPath, opts.ClientCAPath, opts.CertPath, opts.KeyPath, opts.KeyPassphraseFile} {
+		if path == "" {
+			continue
+		}
+		if _, err := os.Stat(path); err != nil {
+			return err
+		}
+		dir := filepath.Dir(path)
+		if watchedDirs[dir] {
+			continue
+		}
+		if err := watcher.Add(dir); err != nil {
+			return err
+		}
+		watchedDirs[dir] = true
+	}
+
+	for _, dir := range []string{opts.CABundleDir, opts.ClientCABundleDir} {
+		if dir == "" {
+			continue
+		}
+		if err := addBundleDirWatches(watcher, dir, watchedDirs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addBundleDirWatches recursively adds an fsnotify watch on dir and every
+// subdirectory beneath it. Watching directories rather than the individual
+// PEM files means both ordinary file changes and a Kubernetes
+// projected-volume "..data" symlink swap at the top level fire events, the
+// same as addWatches does for the single-file paths.
+func addBundleDirWatches(watcher *fsnotify.Watcher, dir string, watchedDirs map[string]bool) error {
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() || watchedDirs[path] {
+			return nil
+		}
+		if err := watcher.Add(path); err != nil {
+			return err
+		}
+		watchedDirs[path] = true
+		return nil
+	})
+}
+
+// certificate returns the most recently loaded server/client leaf
+// certificate, or nil if Options didn't configure one.
+func (w *certWatcher) certificate() *tls.Certificate {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	return w.cert
+}
+
+// Close stops the underlying fsnotify watcher, causing watchChangesLoop and
+// run to return, and stops the periodic expiry check started by
+// startExpiryCheckLoop, if any.
+func (w *certWatcher) Close() error {
+	if w.expiryCheckStop != nil {
+		close(w.expiryCheckStop)
+	}
+	if w.ocspStop != nil {
+		close(w.ocspStop)
+	}
+	return w.watcher.Close()
+}
+
+// startExpiryCheckLoop starts the periodic "never-reloaded cert" expiry
+// check in a background goroutine. It is a no-op if called more than once.
+func (w *certWatcher) startExpiryCheckLoop(interval time.Duration) {
+	if w.expiryCheckStop != nil {
+		return
+	}
+	w.expiryCheckStop = make(chan struct{})
+	go w.checkExpiryLoop(interval, w.expiryCheckStop)
+}
+
+// Subscribe registers a new subscriber and returns a channel of the Events
+// it's interested in (as determined by filter, or all events if filter is
+// nil) along with a CancelFunc to unsubscribe. The channel is buffered, but
+// a slow subscriber that doesn't keep up will have events dropped for it
+// rather than blocking reloads for everyone else.
+func (w *certWatcher) Subscribe(filter func(Event) bool) (<-chan Event, CancelFunc) {
+	if filter == nil {
+		filter = func(Event) bool { return true }
+	}
+
+	sub := &subscription{filter: filter, ch: make(chan Event, subscriberBufferSize)}
+
+	w.subMu.Lock()
+	id := w.nextSubID
+	w.nextSubID++
+	w.subscribers[id] = sub
+	w.subMu.Unlock()
+
+	var once sync.Once
+	cancel := func() {
+		once.Do(func() {
+			w.subMu.Lock()
+			delete(w.subscribers, id)
+			w.subMu.Unlock()
+			close(sub.ch)
+		})
+	}
+	return sub.ch, cancel
+}
+
+func (w *certWatcher) publish(event Event) {
+	w.subMu.Lock()
+	defer w.subMu.Unlock()
+	for _, sub := range w.subscribers {
+		if !sub.filter(event) {
+			continue
+		}
+		select {
+		case sub.ch <- event:
+		default:
+			w.logger.Warn("Dropping TLS reload event, subscriber is not keeping up", zap.String("certificate", event.Path))
+		}
+	}
+}
+
+// watchChangesLoop reacts to filesystem events on the watched paths by
+// reloading the affected certificate or CA pool. certPool and
+// clientCACertPool are mutated in place via AppendCertsFromPEM, so any
+// tls.Config referencing them observes the change without further action
+// from the caller. It is kept for backward compatibility and is implemented
+// on top of Subscribe; new code with more than one TLS consumer sharing this
+// watcher should call Subscribe directly instead, so each consumer can swap
+// its own pool rather than all of them sharing certPool/clientCACertPool. It
+// runs until Close is called.
+func (w *certWatcher) watchChangesLoop(certPool, clientCACertPool *x509.CertPool) {
+	if w.lastReadCA != nil {
+		certPool.AppendCertsFromPEM(w.lastReadCA)
+	}
+	if w.lastReadClientCA != nil {
+		clientCACertPool.AppendCertsFromPEM(w.lastReadClientCA)
+	}
+
+	events, cancel := w.Subscribe(func(e Event) bool {
+		return e.Type == CAReloaded || e.Type == ClientCAReloaded
+	})
+	defer cancel()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for e := range events {
+			switch e.Type {
+			case CAReloaded:
+				certPool.AppendCertsFromPEM(e.pem)
+			case ClientCAReloaded:
+				clientCACertPool.AppendCertsFromPEM(e.pem)
+			}
+		}
+	}()
+
+	w.run()
+	cancel()
+	<-done
+}
+
+// run drives the fsnotify event loop, reloading and publishing whatever
+// changed on each wakeup, until the underlying watcher is closed.
+func (w *certWatcher) run() {
+	for {
+		select {
+		case _, ok := <-w.watcher.Events:
+			if !ok {
+				return
+			}
+			w.reloadCA(w.opts.CAPath, CAReloaded, &w.lastReadCA)
+			w.reloadCA(w.opts.ClientCAPath, ClientCAReloaded, &w.lastReadClientCA)
+			w.reloadCABundleDir(w.opts.CABundleDir, CAReloaded, false)
+			w.reloadCABundleDir(w.opts.ClientCABundleDir, ClientCAReloaded, true)
+			w.reloadCert()
+		case err, ok := <-w.watcher.Errors:
+			if !ok {
+				return
+			}
+			w.logger.Error("Watcher error received", zap.Error(err))
+		}
+	}
+}
+
+// caBundle returns a safe-to-read snapshot of the most recently loaded
+// CAPath PEM bytes. Unlike lastReadCert/Key/Passphrase, lastReadCA can be
+// read from outside the run() goroutine (the OCSP refresh goroutine does,
+// to find the leaf's issuer), so access goes through caMu rather than being
+// an implicit single-goroutine invariant.
+func (w *certWatcher) caBundle() []byte {
+	w.caMu.RLock()
+	defer w.caMu.RUnlock()
+	return w.lastReadCA
+}
+
+// pemChanged reports whether data differs from the bytes last seen at
+// *lastRead, identified by hashing rather than comparing the (potentially
+// large, for bundle directories) PEM content directly. *lastRead is updated
+// unconditionally, successful parse or not, so that repeated fsnotify
+// wakeups for an already-seen version of the file are silently ignored.
+func pemChanged(data []byte, lastRead *[]byte) bool {
+	if *lastRead != nil {
+		oldHash := sha256.Sum256(*lastRead)
+		newHash := sha256.Sum256(data)
+		if oldHash == newHash {
+			return false
+		}
+	}
+	*lastRead = data
+	return true
+}
+
+// reloadCA re-reads path, and if its content changed since the last read,
+// builds a fresh pool from it and publishes eventType with that pool.
+func (w *certWatcher) reloadCA(path string, eventType EventType, lastRead *[]byte) {
+	if path == "" {
+		return
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			w.caMu.RLock()
+			hadCert := *lastRead != nil
+			w.caMu.RUnlock()
+			if hadCert {
+				w.logger.Warn("Certificate has been removed, using the last known version", zap.String("certificate", path))
+			}
+			return
+		}
+		w.recordLoadFailure(path)
+		w.publish(Event{Type: LoadFailed, Path: path, Err: err})
+		w.logger.Error("Failed to load certificate", zap.String("certificate", path), zap.Error(err))
+		return
+	}
+
+	w.caMu.Lock()
+	changed := pemChanged(data, lastRead)
+	w.caMu.Unlock()
+	if !changed {
+		return
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		w.recordLoadFailure(path)
+		w.publish(Event{Type: LoadFailed, Path: path, Err: errNoValidCertsInPEM})
+		w.logger.Error("Failed to load certificate", zap.String("certificate", path), zap.Error(errNoValidCertsInPEM))
+		return
+	}
+
+	w.recordCAFile(path, data)
+	w.publish(Event{Type: eventType, Path: path, Pool: pool, pem: data})
+	w.logger.Info("Loaded modified certificate", zap.String("certificate", path))
+}
+
+// reloadCert re-reads the configured cert/key pair and, if either file (or
+// KeyPassphraseFile) changed since the last read, attempts to load the new
+// pair. The log field "certificate" is attributed to whichever file actually
+// changed, so operators can tell what triggered a reload or a failure.
+func (w *certWatcher) reloadCert() {
+	if w.opts.CertPath == "" || w.opts.KeyPath == "" {
+		return
+	}
+
+	certData, err := os.ReadFile(w.opts.CertPath)
+	if err != nil {
+		w.recordLoadFailure(w.opts.CertPath)
+		w.publish(Event{Type: LoadFailed, Path: w.opts.CertPath, Err: err})
+		w.logger.Error("Failed to load certificate", zap.String("certificate", w.opts.CertPath), zap.Error(err))
+		return
+	}
+	keyData, err := os.ReadFile(w.opts.KeyPath)
+	if err != nil {
+		w.recordLoadFailure(w.opts.KeyPath)
+		w.publish(Event{Type: LoadFailed, Path: w.opts.KeyPath, Err: err})
+		w.logger.Error("Failed to load certificate", zap.String("certificate", w.opts.KeyPath), zap.Error(err))
+		return
+	}
+	var passphraseData []byte
+	if w.opts.KeyPassphraseFile != "" {
+		passphraseData, err = os.ReadFile(w.opts.KeyPassphraseFile)
+		if err != nil {
+			w.recordLoadFailure(w.opts.KeyPassphraseFile)
+			w.publish(Event{Type: LoadFailed, Path: w.opts.KeyPassphraseFile, Err: err})
+			w.logger.Error("Failed to load certificate", zap.String("certificate", w.opts.KeyPassphraseFile), zap.Error(err))
+			return
+		}
+	}
+
+	certChanged := !bytes.Equal(certData, w.lastReadCert)
+	keyChanged := !bytes.Equal(keyData, w.lastReadKey)
+	passphraseChanged := !bytes.Equal(passphraseData, w.lastReadPassphrase)
+	if !certChanged && !keyChanged && !passphraseChanged {
+		return
+	}
+
+	changedPath := w.opts.KeyPassphraseFile
+	if keyChanged {
+		changedPath = w.opts.KeyPath
+	}
+	if certChanged {
+		changedPath = w.opts.CertPath
+	}
+	w.lastReadCert = certData
+	w.lastReadKey = keyData
+	w.lastReadPassphrase = passphraseData
+
+	decryptedKey, err := decryptKeyIfNeeded(keyData, w.opts)
+	if err != nil {
+		w.recordLoadFailure(changedPath)
+		w.publish(Event{Type: LoadFailed, Path: changedPath, Err: err})
+		if keyErr := (*keyDecryptError)(nil); errors.As(err, &keyErr) {
+			w.logger.Error("Failed to decrypt private key", zap.String("certificate", changedPath), zap.Error(err))
+		} else {
+			w.logger.Error("Failed to load certificate", zap.String("certificate", changedPath), zap.Error(err))
+		}
+		return
+	}
+
+	cert, err := tls.X509KeyPair(certData, decryptedKey)
+	if err != nil {
+		w.recordLoadFailure(changedPath)
+		w.publish(Event{Type: LoadFailed, Path: changedPath, Err: err})
+		w.logger.Error("Failed to load certificate", zap.String("certificate", changedPath), zap.Error(err))
+		return
+	}
+
+	w.mu.Lock()
+	w.cert = &cert
+	w.mu.Unlock()
+
+	if leaf, err := x509.ParseCertificate(cert.Certificate[0]); err == nil {
+		w.recordCertificate(w.opts.CertPath, leaf)
+	}
+
+	w.publish(Event{Type: CertReloaded, Path: changedPath, Cert: &cert})
+	w.logger.Info("Loaded modified certificate", zap.String("certificate", changedPath))
+}
+
+// loadCABundleDir builds a fresh pool from every *.pem file found
+// recursively under dir, skipping (with a warning, rather than failing the
+// whole bundle) any file that can't be read or doesn't parse as a
+// certificate. It returns errNoValidCertsInPEM if the directory contains no
+// usable certificate at all, along with a hash of the aggregate content
+// (path and bytes of every loaded file) that reloadCABundleDir uses to
+// detect whether anything under dir actually changed.
+func (w *certWatcher) loadCABundleDir(dir string) (*x509.CertPool, [sha256.Size]byte, error) {
+	pool := x509.NewCertPool()
+	hasher := sha256.New()
+	loaded := 0
+
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || filepath.Ext(path) != ".pem" {
+			return nil
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			w.logger.Warn("Failed to read CA bundle file, skipping", zap.String("certificate", path), zap.Error(err))
+			return nil
+		}
+		if !pool.AppendCertsFromPEM(data) {
+			w.logger.Warn("Failed to parse CA bundle file, skipping", zap.String("certificate", path))
+			return nil
+		}
+		w.recordCAFile(path, data)
+		hasher.Write([]byte(path))
+		hasher.Write(data)
+		loaded++
+		return nil
+	})
+	var hash [sha256.Size]byte
+	if err != nil {
+		return nil, hash, err
+	}
+	if loaded == 0 {
+		return nil, hash, errNoValidCertsInPEM
+	}
+	copy(hash[:], hasher.Sum(nil))
+	return pool, hash, nil
+}
+
+// reloadCABundleDir rebuilds the pool for dir (CABundleDir if isClientCA is
+// false, otherwise ClientCABundleDir) and atomically swaps it into the pool
+// returned by CACertPool/ClientCACertPool, so a root that was removed from
+// the directory is actually dropped rather than lingering, which the
+// in-place AppendCertsFromPEM used by reloadCA can't do. Like reloadCA, it's
+// a no-op when the directory's content hasn't actually changed, so a
+// fsnotify wakeup for an unrelated path (e.g. the leaf cert) doesn't flood
+// subscribers and logs with spurious reloads.
+func (w *certWatcher) reloadCABundleDir(dir string, eventType EventType, isClientCA bool) {
+	if dir == "" {
+		return
+	}
+
+	pool, hash, err := w.loadCABundleDir(dir)
+	if err != nil {
+		w.recordLoadFailure(dir)
+		w.publish(Event{Type: LoadFailed, Path: dir, Err: err})
+		w.logger.Error("Failed to load certificate", zap.String("certificate", dir), zap.Error(err))
+		return
+	}
+
+	w.poolMu.Lock()
+	lastHash := &w.lastReadCABundleHash
+	if isClientCA {
+		lastHash = &w.lastReadClientCABundleHash
+	}
+	if *lastHash == hash {
+		w.poolMu.Unlock()
+		return
+	}
+	*lastHash = hash
+	if isClientCA {
+		w.clientCABundlePool = pool
+	} else {
+		w.caBundlePool = pool
+	}
+	w.poolMu.Unlock()
+
+	w.publish(Event{Type: eventType, Path: dir, Pool: pool})
+	w.logger.Info("Loaded modified certificate", zap.String("certificate", dir))
+}
+
+// CACertPool returns the most recently loaded CABundleDir pool, or nil if
+// Options didn't configure one.
+func (w *certWatcher) CACertPool() *x509.CertPool {
+	w.poolMu.RLock()
+	defer w.poolMu.RUnlock()
+	return w.caBundlePool
+}
+
+// ClientCACertPool returns the most recently loaded ClientCABundleDir pool,
+// or nil if Options didn't configure one.
+func (w *certWatcher) ClientCACertPool() *x509.CertPool {
+	w.poolMu.RLock()
+	defer w.poolMu.RUnlock()
+	return w.clientCABundlePool
+}
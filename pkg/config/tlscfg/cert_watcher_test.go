@@ -15,8 +15,16 @@
 package tlscfg
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
 	"crypto/tls"
 	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
 	"testing"
@@ -28,6 +36,7 @@ import (
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 	"go.uber.org/zap/zaptest/observer"
+	"golang.org/x/crypto/ocsp"
 )
 
 const (
@@ -39,6 +48,11 @@ const (
 	caCert      = "./testdata/example-CA-cert.pem"
 	wrongCaCert = "./testdata/wrong-CA-cert.pem"
 	badCaCert   = "./testdata/bad-CA-cert.txt"
+
+	encryptedServerCert = "./testdata/example-server-cert-encrypted.pem"
+	encryptedServerKey  = "./testdata/example-server-key-encrypted.pem"
+	keyPassphraseFile   = "./testdata/example-key-passphrase.txt"
+	keyPassphrase       = "testpassphrase"
 )
 
 func TestReload(t *testing.T) {
@@ -455,6 +469,366 @@ func TestAddCertsToWatch_remove_ca(t *testing.T) {
 	assert.True(t, logObserver.FilterMessage("Certificate has been removed, using the last known version").FilterField(zap.String("certificate", clientCaFile.Name())).Len() > 0)
 }
 
+func TestSubscribe_fanOut(t *testing.T) {
+	// copy the CA cert to temp so we can modify it
+	caFile, err := os.CreateTemp("", "ca.crt")
+	require.NoError(t, err)
+	defer os.Remove(caFile.Name())
+	caData, err := os.ReadFile(caCert)
+	require.NoError(t, err)
+	_, err = caFile.Write(caData)
+	require.NoError(t, err)
+	caFile.Close()
+
+	watcher, err := newCertWatcher(Options{CAPath: caFile.Name()}, zap.NewNop())
+	require.NoError(t, err)
+	defer watcher.Close()
+
+	eventsA, cancelA := watcher.Subscribe(func(e Event) bool { return e.Type == CAReloaded })
+	eventsB, cancelB := watcher.Subscribe(func(e Event) bool { return e.Type == CAReloaded })
+	defer cancelB()
+
+	certPool := x509.NewCertPool()
+	go watcher.watchChangesLoop(certPool, certPool)
+
+	caData, err = os.ReadFile(wrongCaCert)
+	require.NoError(t, err)
+	err = syncWrite(caFile.Name(), caData, 0o644)
+	require.NoError(t, err)
+
+	var gotA, gotB Event
+	select {
+	case gotA = <-eventsA:
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for subscriber A's event")
+	}
+	select {
+	case gotB = <-eventsB:
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for subscriber B's event")
+	}
+	assert.Equal(t, caFile.Name(), gotA.Path)
+	assert.Equal(t, caFile.Name(), gotB.Path)
+
+	// Cancelling one subscription must not affect the other: it should keep
+	// receiving subsequent events.
+	cancelA()
+	_, stillOpen := <-eventsA
+	assert.False(t, stillOpen, "eventsA should be closed after cancelA")
+
+	caData, err = os.ReadFile(caCert)
+	require.NoError(t, err)
+	err = syncWrite(caFile.Name(), caData, 0o644)
+	require.NoError(t, err)
+
+	select {
+	case gotB = <-eventsB:
+		assert.Equal(t, caFile.Name(), gotB.Path)
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for subscriber B's second event")
+	}
+}
+
+func TestRecordCAFile_multiCertBundle(t *testing.T) {
+	clientData, err := os.ReadFile(clientCert)
+	require.NoError(t, err)
+	serverData, err := os.ReadFile(serverCert)
+	require.NoError(t, err)
+	bundle := append(append([]byte{}, clientData...), serverData...)
+
+	watcher := &certWatcher{logger: zap.NewNop()}
+	watcher.recordCAFile("bundle.pem", bundle)
+
+	info := watcher.CertificateInfo()
+	require.Len(t, info, 2, "both certificates in the bundle should be recorded")
+	for _, ci := range info {
+		assert.Equal(t, "bundle.pem", ci.Path)
+	}
+
+	// Reloading the same path with a bundle containing only one certificate
+	// must drop the stale entry for the certificate that's no longer there.
+	watcher.recordCAFile("bundle.pem", serverData)
+	info = watcher.CertificateInfo()
+	assert.Len(t, info, 1, "stale entries for the removed certificate should be cleared")
+}
+
+func TestExpiryCheckInterval(t *testing.T) {
+	tests := []struct {
+		name      string
+		threshold time.Duration
+		expected  time.Duration
+	}{
+		{name: "zero defaults to DefaultExpiryWarnThreshold, then caps at an hour", threshold: 0, expected: maxExpiryCheckInterval},
+		{name: "short threshold floors at a minute", threshold: time.Minute, expected: time.Minute},
+		{name: "large threshold caps at an hour", threshold: 30 * 24 * time.Hour, expected: maxExpiryCheckInterval},
+		{name: "mid-range threshold is a quarter of it", threshold: 2 * time.Hour, expected: 30 * time.Minute},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.expected, expiryCheckInterval(test.threshold))
+		})
+	}
+}
+
+func TestReload_encryptedKey(t *testing.T) {
+	watcher, err := newCertWatcher(Options{
+		CertPath:      encryptedServerCert,
+		KeyPath:       encryptedServerKey,
+		KeyPassphrase: keyPassphrase,
+	}, zap.NewNop())
+	require.NoError(t, err)
+	defer watcher.Close()
+
+	cert := watcher.certificate()
+	require.NotNil(t, cert)
+	expectedLeaf, err := x509.ParseCertificate(cert.Certificate[0])
+	require.NoError(t, err)
+	assert.Equal(t, "example.com", expectedLeaf.Subject.CommonName)
+}
+
+func TestReload_encryptedKey_passphraseFile(t *testing.T) {
+	watcher, err := newCertWatcher(Options{
+		CertPath:          encryptedServerCert,
+		KeyPath:           encryptedServerKey,
+		KeyPassphraseFile: keyPassphraseFile,
+	}, zap.NewNop())
+	require.NoError(t, err)
+	defer watcher.Close()
+	assert.NotNil(t, watcher.certificate())
+}
+
+func TestReload_encryptedKey_wrongPassphrase(t *testing.T) {
+	_, err := newCertWatcher(Options{
+		CertPath:      encryptedServerCert,
+		KeyPath:       encryptedServerKey,
+		KeyPassphrase: "not-the-right-passphrase",
+	}, zap.NewNop())
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "failed to decrypt private key")
+}
+
+func TestReload_encryptedKey_noPassphrase(t *testing.T) {
+	_, err := newCertWatcher(Options{
+		CertPath: encryptedServerCert,
+		KeyPath:  encryptedServerKey,
+	}, zap.NewNop())
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), errNoKeyPassphrase.Error())
+}
+
+// generateOCSPTestChain builds a throwaway self-signed issuer and a leaf
+// certificate signed by it, for tests that need refreshOCSPStaple to find an
+// issuer and talk to a real (mocked) OCSP responder.
+func generateOCSPTestChain(t *testing.T) (issuerCert *x509.Certificate, issuerKey *ecdsa.PrivateKey, leafCert *x509.Certificate, leafDER, issuerDER []byte, leafKeyPEM []byte) {
+	t.Helper()
+
+	issuerKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	issuerTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test-issuer"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+	}
+	issuerDER, err = x509.CreateCertificate(rand.Reader, issuerTemplate, issuerTemplate, &issuerKey.PublicKey, issuerKey)
+	require.NoError(t, err)
+	issuerCert, err = x509.ParseCertificate(issuerDER)
+	require.NoError(t, err)
+
+	leafKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	leafTemplate := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "test-leaf"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	leafDER, err = x509.CreateCertificate(rand.Reader, leafTemplate, issuerTemplate, &leafKey.PublicKey, issuerKey)
+	require.NoError(t, err)
+	leafCert, err = x509.ParseCertificate(leafDER)
+	require.NoError(t, err)
+
+	keyDER, err := x509.MarshalPKCS8PrivateKey(leafKey)
+	require.NoError(t, err)
+	leafKeyPEM = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+
+	return issuerCert, issuerKey, leafCert, leafDER, issuerDER, leafKeyPEM
+}
+
+func TestRefreshOCSPStaple(t *testing.T) {
+	issuerCert, issuerKey, leafCert, leafDER, issuerDER, leafKeyPEM := generateOCSPTestChain(t)
+
+	responder := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		respDER, err := ocsp.CreateResponse(issuerCert, issuerCert, ocsp.ResponseTemplate{
+			Status:       ocsp.Good,
+			SerialNumber: leafCert.SerialNumber,
+			ThisUpdate:   time.Now(),
+			NextUpdate:   time.Now().Add(time.Hour),
+		}, issuerKey)
+		require.NoError(t, err)
+		w.Header().Set("Content-Type", "application/ocsp-response")
+		w.Write(respDER)
+	}))
+	defer responder.Close()
+
+	certFile, err := os.CreateTemp("", "leaf-chain.crt")
+	require.NoError(t, err)
+	defer os.Remove(certFile.Name())
+	_, err = certFile.Write(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: leafDER}))
+	require.NoError(t, err)
+	_, err = certFile.Write(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: issuerDER}))
+	require.NoError(t, err)
+	certFile.Close()
+
+	keyFile, err := os.CreateTemp("", "leaf.key")
+	require.NoError(t, err)
+	defer os.Remove(keyFile.Name())
+	_, err = keyFile.Write(leafKeyPEM)
+	require.NoError(t, err)
+	keyFile.Close()
+
+	watcher, err := newCertWatcher(Options{
+		CertPath:              certFile.Name(),
+		KeyPath:               keyFile.Name(),
+		OCSPEnabled:           true,
+		OCSPResponderOverride: responder.URL,
+	}, zap.NewNop())
+	require.NoError(t, err)
+	defer watcher.Close()
+
+	before := watcher.certificate()
+	require.Nil(t, before.OCSPStaple)
+
+	watcher.refreshOCSPStaple()
+
+	after := watcher.certificate()
+	assert.NotSame(t, before, after, "refreshOCSPStaple must swap in a new *tls.Certificate, not mutate the old one")
+	assert.Nil(t, before.OCSPStaple, "the certificate pointer handed out before the refresh must stay untouched")
+	assert.NotEmpty(t, after.OCSPStaple)
+}
+
+func TestFetchOCSPStaple_responderTimeout(t *testing.T) {
+	originalTimeout := ocspHTTPClient.Timeout
+	ocspHTTPClient.Timeout = 50 * time.Millisecond
+	defer func() { ocspHTTPClient.Timeout = originalTimeout }()
+
+	unblock := make(chan struct{})
+	responder := httptest.NewServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
+		<-unblock
+	}))
+	defer responder.Close()
+	defer close(unblock)
+
+	issuerCert, _, leafCert, _, _, _ := generateOCSPTestChain(t)
+
+	done := make(chan error, 1)
+	go func() {
+		_, _, err := fetchOCSPStaple(responder.URL, leafCert, issuerCert)
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		assert.Error(t, err, "a hanging responder past ocspHTTPClient.Timeout must fail the fetch, not block forever")
+	case <-time.After(2 * time.Second):
+		t.Fatal("fetchOCSPStaple did not time out against an unresponsive responder")
+	}
+}
+
+func TestOcspRefreshInterval(t *testing.T) {
+	tests := []struct {
+		name       string
+		opts       Options
+		nextUpdate time.Time
+		expected   time.Duration
+	}{
+		{
+			name:     "no staple yet uses OCSPRefreshInterval",
+			opts:     Options{OCSPRefreshInterval: 10 * time.Minute},
+			expected: 10 * time.Minute,
+		},
+		{
+			name:     "zero OCSPRefreshInterval defaults to an hour",
+			opts:     Options{},
+			expected: defaultOCSPRefreshInterval,
+		},
+		{
+			// ocspRefreshJitter (5m) exceeds the margin to NextUpdate, so
+			// ocspRefreshInterval falls back to its one-minute floor instead
+			// of waiting the full configured interval.
+			name:       "staple expiring soon is refreshed sooner than the configured interval",
+			opts:       Options{OCSPRefreshInterval: time.Hour},
+			nextUpdate: time.Now().Add(2 * time.Minute),
+			expected:   time.Minute,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := &certWatcher{opts: test.opts, ocspNextUpdate: test.nextUpdate}
+			assert.Equal(t, test.expected, w.ocspRefreshInterval())
+		})
+	}
+}
+
+func TestReload_ca_bundle_dir(t *testing.T) {
+	bundleDir, err := os.MkdirTemp("", "ca-bundle")
+	require.NoError(t, err)
+	defer os.RemoveAll(bundleDir)
+
+	caData, err := os.ReadFile(caCert)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(bundleDir, "root-a.pem"), caData, 0o644))
+
+	zcore, logObserver := observer.New(zapcore.InfoLevel)
+	logger := zap.New(zcore)
+	watcher, err := newCertWatcher(Options{CABundleDir: bundleDir}, logger)
+	require.NoError(t, err)
+	defer watcher.Close()
+
+	certPool := x509.NewCertPool()
+	go watcher.watchChangesLoop(certPool, certPool)
+
+	require.NotNil(t, watcher.CACertPool())
+
+	// Adding a second root under the directory must trigger a reload.
+	wrongData, err := os.ReadFile(wrongCaCert)
+	require.NoError(t, err)
+	rootBPath := filepath.Join(bundleDir, "root-b.pem")
+	require.NoError(t, syncWrite(rootBPath, wrongData, 0o644))
+
+	waitUntil(func() bool {
+		return logObserver.FilterMessage("Loaded modified certificate").
+			FilterField(zap.String("certificate", bundleDir)).Len() > 0
+	}, 100, time.Millisecond*20)
+	firstReloadCount := logObserver.FilterMessage("Loaded modified certificate").
+		FilterField(zap.String("certificate", bundleDir)).Len()
+	require.Greater(t, firstReloadCount, 0, "expected a reload after adding root-b.pem")
+
+	// A second fsnotify wakeup whose content hash is unchanged (e.g. an
+	// unrelated touch of the same file) must not trigger another reload or
+	// publish: the directory's aggregate content hash hasn't changed.
+	require.NoError(t, syncWrite(rootBPath, wrongData, 0o644))
+	time.Sleep(200 * time.Millisecond)
+	assert.Equal(t, firstReloadCount, logObserver.FilterMessage("Loaded modified certificate").
+		FilterField(zap.String("certificate", bundleDir)).Len(),
+		"rewriting a bundle file with identical content must not trigger another reload")
+}
+
+func TestLoadCABundleDir_noValidCerts(t *testing.T) {
+	bundleDir, err := os.MkdirTemp("", "ca-bundle-empty")
+	require.NoError(t, err)
+	defer os.RemoveAll(bundleDir)
+
+	watcher := &certWatcher{logger: zap.NewNop()}
+	_, _, err = watcher.loadCABundleDir(bundleDir)
+	assert.ErrorIs(t, err, errNoValidCertsInPEM)
+}
+
 func waitUntil(f func() bool, iterations int, sleepInterval time.Duration) {
 	for i := 0; i < iterations; i++ {
 		if f() {
@@ -0,0 +1,119 @@
+// Copyright (c) 2020 The Jaeger Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tlscfg
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"os"
+
+	"github.com/youmark/pkcs8"
+)
+
+// KeyDecryptor decrypts a passphrase-protected private key PEM block into
+// its raw DER bytes, so certWatcher can hand it to tls.X509KeyPair. Operators
+// who source the cleartext key from an external KMS instead of a local
+// passphrase can plug in their own implementation via Options.KeyDecryptor.
+type KeyDecryptor interface {
+	Decrypt(block *pem.Block, passphrase []byte) ([]byte, error)
+}
+
+var errNoKeyPassphrase = errors.New("private key is encrypted but no passphrase was configured")
+
+// defaultKeyDecryptor is used when Options.KeyDecryptor is nil. It handles
+// both PKCS#8 "ENCRYPTED PRIVATE KEY" blocks and the legacy OpenSSL
+// "Proc-Type: 4,ENCRYPTED"/"DEK-Info" header format.
+type defaultKeyDecryptor struct{}
+
+func (defaultKeyDecryptor) Decrypt(block *pem.Block, passphrase []byte) ([]byte, error) {
+	if len(passphrase) == 0 {
+		return nil, errNoKeyPassphrase
+	}
+
+	if x509.IsEncryptedPEMBlock(block) { //nolint:staticcheck // legacy "Proc-Type: 4,ENCRYPTED" format, still in use
+		return x509.DecryptPEMBlock(block, passphrase) //nolint:staticcheck
+	}
+
+	key, err := pkcs8.ParsePKCS8PrivateKey(block.Bytes, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	return x509.MarshalPKCS8PrivateKey(key)
+}
+
+// isEncryptedKeyBlock reports whether block holds a key that needs
+// decrypting before it can be handed to tls.X509KeyPair.
+func isEncryptedKeyBlock(block *pem.Block) bool {
+	return block.Type == "ENCRYPTED PRIVATE KEY" || x509.IsEncryptedPEMBlock(block) //nolint:staticcheck
+}
+
+// resolveKeyPassphrase reads the passphrase for an encrypted KeyPath from
+// opts, preferring KeyPassphraseFile (re-read on every call, so rotating the
+// file takes effect without a restart) over the literal KeyPassphrase.
+func resolveKeyPassphrase(opts Options) ([]byte, error) {
+	if opts.KeyPassphraseFile != "" {
+		data, err := os.ReadFile(opts.KeyPassphraseFile)
+		if err != nil {
+			return nil, err
+		}
+		return bytes.TrimSpace(data), nil
+	}
+	if opts.KeyPassphrase != "" {
+		return []byte(opts.KeyPassphrase), nil
+	}
+	return nil, nil
+}
+
+// keyDecryptError distinguishes a failure to decrypt an already-read private
+// key from a more general failure to load the certificate, so callers can
+// log "Failed to decrypt private key" instead of "Failed to load
+// certificate".
+type keyDecryptError struct {
+	err error
+}
+
+func (e *keyDecryptError) Error() string { return e.err.Error() }
+func (e *keyDecryptError) Unwrap() error { return e.err }
+
+// decryptKeyIfNeeded returns keyData unchanged if it isn't encrypted, or its
+// decrypted, PEM re-encoded form (re-tagged as a plain "PRIVATE KEY" block)
+// otherwise. The decrypted key only ever lives in memory; it is never
+// written back to disk.
+func decryptKeyIfNeeded(keyData []byte, opts Options) ([]byte, error) {
+	block, rest := pem.Decode(keyData)
+	if block == nil || !isEncryptedKeyBlock(block) {
+		return keyData, nil
+	}
+
+	passphrase, err := resolveKeyPassphrase(opts)
+	if err != nil {
+		return nil, &keyDecryptError{err}
+	}
+
+	decryptor := opts.KeyDecryptor
+	if decryptor == nil {
+		decryptor = defaultKeyDecryptor{}
+	}
+
+	der, err := decryptor.Decrypt(block, passphrase)
+	if err != nil {
+		return nil, &keyDecryptError{err}
+	}
+
+	decrypted := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	return append(decrypted, rest...), nil
+}
@@ -0,0 +1,227 @@
+// Copyright (c) 2020 The Jaeger Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tlscfg
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/jaegertracing/jaeger/pkg/metrics"
+)
+
+// CertificateInfo is a snapshot of metadata parsed out of a loaded
+// certificate. It's returned by certWatcher.CertificateInfo() for admin
+// endpoints, such as query/collector's /tls/status handler, that want to
+// surface whether the file-watching reload loop is actually keeping
+// material fresh.
+type CertificateInfo struct {
+	Path         string
+	Subject      string
+	DNSNames     []string
+	SerialNumber string
+	NotBefore    time.Time
+	NotAfter     time.Time
+}
+
+func newCertificateInfo(path string, cert *x509.Certificate) CertificateInfo {
+	return CertificateInfo{
+		Path:         path,
+		Subject:      cert.Subject.String(),
+		DNSNames:     cert.DNSNames,
+		SerialNumber: cert.SerialNumber.String(),
+		NotBefore:    cert.NotBefore,
+		NotAfter:     cert.NotAfter,
+	}
+}
+
+// CertificateInfo returns metadata about every certificate currently loaded
+// by the watcher (the leaf certificate, the CA, and the client CA). A CA or
+// client CA bundle file can hold more than one certificate, so entries are
+// keyed by certInfoKey(path, serial number) rather than by bare path.
+func (w *certWatcher) CertificateInfo() map[string]CertificateInfo {
+	w.infoMu.RLock()
+	defer w.infoMu.RUnlock()
+
+	info := make(map[string]CertificateInfo, len(w.certInfo))
+	for key, ci := range w.certInfo {
+		info[key] = ci
+	}
+	return info
+}
+
+// certInfoKey identifies a single certificate in certWatcher.certInfo. path
+// alone isn't unique, since a CA/client CA bundle file can hold more than
+// one certificate.
+func certInfoKey(path, serialNumber string) string {
+	return path + "#" + serialNumber
+}
+
+// recordCertificate parses cert, updates CertificateInfo for path, reports
+// expiration telemetry via the metrics factory (if one was attached with
+// withMetrics), and logs a warning if the certificate is within
+// ExpiryWarnThreshold of expiring.
+func (w *certWatcher) recordCertificate(path string, cert *x509.Certificate) {
+	info := newCertificateInfo(path, cert)
+
+	w.infoMu.Lock()
+	if w.certInfo == nil {
+		w.certInfo = make(map[string]CertificateInfo)
+	}
+	w.certInfo[certInfoKey(path, info.SerialNumber)] = info
+	w.infoMu.Unlock()
+
+	if w.metrics != nil {
+		tags := map[string]string{
+			"path":    path,
+			"subject": info.Subject,
+			"serial":  info.SerialNumber,
+		}
+		w.metrics.Gauge(metrics.Options{Name: "tls_certificate_expiration_seconds", Tags: tags}).
+			Update(int64(time.Until(cert.NotAfter).Seconds()))
+		w.metrics.Gauge(metrics.Options{Name: "tls_certificate_not_before_seconds", Tags: tags}).
+			Update(cert.NotBefore.Unix())
+	}
+
+	w.warnIfNearingExpiry(info)
+}
+
+// recordLoadFailure increments the load failure counter for path, if a
+// metrics factory was attached.
+func (w *certWatcher) recordLoadFailure(path string) {
+	if w.metrics == nil {
+		return
+	}
+	w.metrics.Counter(metrics.Options{
+		Name: "tls_certificate_load_failures_total",
+		Tags: map[string]string{"path": path},
+	}).Inc(1)
+}
+
+func (w *certWatcher) warnIfNearingExpiry(info CertificateInfo) {
+	threshold := w.opts.ExpiryWarnThreshold
+	if threshold <= 0 {
+		threshold = DefaultExpiryWarnThreshold
+	}
+
+	remaining := time.Until(info.NotAfter)
+	if remaining > threshold {
+		return
+	}
+
+	w.logger.Warn("Certificate nearing expiration",
+		zap.String("certificate", info.Path),
+		zap.String("subject", info.Subject),
+		zap.Strings("dns_names", info.DNSNames),
+		zap.String("serial", info.SerialNumber),
+		zap.Duration("remaining", remaining),
+	)
+}
+
+// maxExpiryCheckInterval bounds how infrequently the periodic expiry check
+// runs, regardless of how large ExpiryWarnThreshold is configured.
+const maxExpiryCheckInterval = time.Hour
+
+// expiryCheckInterval picks how often startExpiryCheckLoop re-evaluates
+// loaded certificates: often enough that a threshold shorter than an hour is
+// still checked several times before it would fire, but never more often
+// than maxExpiryCheckInterval.
+func expiryCheckInterval(threshold time.Duration) time.Duration {
+	if threshold <= 0 {
+		threshold = DefaultExpiryWarnThreshold
+	}
+	interval := threshold / 4
+	if interval < time.Minute {
+		return time.Minute
+	}
+	if interval > maxExpiryCheckInterval {
+		return maxExpiryCheckInterval
+	}
+	return interval
+}
+
+// withMetrics attaches a metrics factory to the watcher, so that every
+// certificate it loads from now on reports expiration telemetry through it.
+// A nil factory disables metrics reporting (the default).
+func (w *certWatcher) withMetrics(factory metrics.Factory) *certWatcher {
+	w.metrics = factory
+	return w
+}
+
+// recordCAFile parses every certificate in a CA/client CA PEM bundle and
+// records telemetry for each, since a trust bundle can contain more than one
+// root. Any CertificateInfo previously recorded for path is cleared first, so
+// a certificate dropped from the bundle on reload doesn't linger forever.
+func (w *certWatcher) recordCAFile(path string, data []byte) {
+	w.clearCertInfo(path)
+	for _, cert := range parseCertificatesPEM(data) {
+		w.recordCertificate(path, cert)
+	}
+}
+
+// clearCertInfo drops every CertificateInfo entry previously recorded for
+// path.
+func (w *certWatcher) clearCertInfo(path string) {
+	w.infoMu.Lock()
+	defer w.infoMu.Unlock()
+	for key, info := range w.certInfo {
+		if info.Path == path {
+			delete(w.certInfo, key)
+		}
+	}
+}
+
+// parseCertificatesPEM decodes every CERTIFICATE block in data, skipping
+// (rather than failing on) any block that isn't a valid certificate, since
+// callers use this purely for telemetry and a single malformed entry
+// shouldn't hide metadata about the rest of the bundle.
+func parseCertificatesPEM(data []byte) []*x509.Certificate {
+	var certs []*x509.Certificate
+	rest := data
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			return certs
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		if cert, err := x509.ParseCertificate(block.Bytes); err == nil {
+			certs = append(certs, cert)
+		}
+	}
+}
+
+// checkExpiryLoop periodically re-evaluates every currently loaded
+// certificate against ExpiryWarnThreshold, so that a certificate which is
+// never reloaded (e.g. because rotation stalled) still gets flagged instead
+// of only being checked once at load time. It runs until stop is closed.
+func (w *certWatcher) checkExpiryLoop(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			for _, info := range w.CertificateInfo() {
+				w.warnIfNearingExpiry(info)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
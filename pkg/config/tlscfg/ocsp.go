@@ -0,0 +1,276 @@
+// Copyright (c) 2020 The Jaeger Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tlscfg
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+
+	"go.uber.org/zap"
+
+	"github.com/jaegertracing/jaeger/pkg/metrics"
+)
+
+var (
+	errNoOCSPResponder = errors.New("certificate has no OCSP responder and OCSPResponderOverride is not set")
+	errNoOCSPIssuer    = errors.New("unable to determine the certificate's issuer for OCSP stapling")
+)
+
+// defaultOCSPRefreshInterval is used when Options.OCSPRefreshInterval is
+// unset.
+const defaultOCSPRefreshInterval = time.Hour
+
+// ocspRefreshJitter is subtracted from the current staple's NextUpdate when
+// deciding how long to wait before the next refresh, so the watcher renews a
+// staple somewhat ahead of it actually expiring.
+const ocspRefreshJitter = 5 * time.Minute
+
+// ocspHTTPTimeout bounds how long fetchOCSPStaple waits on the OCSP
+// responder. ocspLoop runs synchronously on a single goroutine, so an
+// unbounded request to an unreachable or slow responder would otherwise hang
+// every future scheduled and CertReloaded-triggered refresh for the rest of
+// the process's life instead of just failing this one attempt.
+const ocspHTTPTimeout = 10 * time.Second
+
+// ocspHTTPClient is used instead of http.DefaultClient so every OCSP request
+// is bounded by ocspHTTPTimeout.
+var ocspHTTPClient = &http.Client{Timeout: ocspHTTPTimeout}
+
+// startOCSPLoop starts the background goroutine that keeps the leaf
+// certificate's OCSP staple fresh. It is a no-op unless Options.OCSPEnabled
+// is set, or if already started. Close stops it.
+func (w *certWatcher) startOCSPLoop() {
+	if !w.opts.OCSPEnabled || w.ocspStop != nil {
+		return
+	}
+	w.ocspStop = make(chan struct{})
+	go w.ocspLoop(w.ocspStop)
+}
+
+// ocspLoop refreshes the OCSP staple immediately, then keeps it fresh by
+// reacting to every leaf certificate reload as well as a periodic timer, so
+// a staple that's simply nearing expiry still gets renewed even if the
+// underlying certificate never changes. It runs until stop is closed.
+func (w *certWatcher) ocspLoop(stop chan struct{}) {
+	events, cancel := w.Subscribe(func(e Event) bool { return e.Type == CertReloaded })
+	defer cancel()
+
+	w.refreshOCSPStaple()
+
+	timer := time.NewTimer(w.ocspRefreshInterval())
+	defer timer.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case _, ok := <-events:
+			if !ok {
+				return
+			}
+			w.refreshOCSPStaple()
+			resetTimer(timer, w.ocspRefreshInterval())
+		case <-timer.C:
+			w.refreshOCSPStaple()
+			resetTimer(timer, w.ocspRefreshInterval())
+		}
+	}
+}
+
+// refreshOCSPStaple fetches a fresh OCSP response for the current leaf
+// certificate and attaches it to tls.Certificate.OCSPStaple. On failure, the
+// previous staple (if any) is left in place until it expires, mirroring how
+// reloadCA keeps serving the last known good CA pool when a reload fails.
+func (w *certWatcher) refreshOCSPStaple() {
+	w.ocspMu.RLock()
+	nextUpdate := w.ocspNextUpdate
+	w.ocspMu.RUnlock()
+	if !nextUpdate.IsZero() && time.Now().After(nextUpdate) {
+		w.mu.Lock()
+		if w.cert != nil && w.cert.OCSPStaple != nil {
+			cloned := *w.cert
+			cloned.OCSPStaple = nil
+			w.cert = &cloned
+		}
+		w.mu.Unlock()
+	}
+
+	cert := w.certificate()
+	if cert == nil {
+		return
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		w.recordOCSPFailure()
+		w.logger.Error("Failed to refresh OCSP response", zap.String("certificate", w.opts.CertPath), zap.Error(err))
+		return
+	}
+
+	issuer := w.findOCSPIssuer(cert, leaf)
+	if issuer == nil {
+		w.recordOCSPFailure()
+		w.logger.Error("Failed to refresh OCSP response", zap.String("certificate", w.opts.CertPath), zap.Error(errNoOCSPIssuer))
+		return
+	}
+
+	responderURL := w.opts.OCSPResponderOverride
+	if responderURL == "" {
+		if len(leaf.OCSPServer) == 0 {
+			w.recordOCSPFailure()
+			w.logger.Error("Failed to refresh OCSP response", zap.String("certificate", w.opts.CertPath), zap.Error(errNoOCSPResponder))
+			return
+		}
+		responderURL = leaf.OCSPServer[0]
+	}
+
+	staple, response, err := fetchOCSPStaple(responderURL, leaf, issuer)
+	if err != nil {
+		w.recordOCSPFailure()
+		w.logger.Error("Failed to refresh OCSP response", zap.String("certificate", w.opts.CertPath), zap.Error(err))
+		return
+	}
+
+	w.mu.Lock()
+	if w.cert != nil {
+		// Swap in a new *tls.Certificate rather than mutating the one w.cert
+		// already points to: that pointer may be in the hands of an
+		// in-flight handshake (via GetCertificate) or a CertReloaded
+		// subscriber, and those readers don't take w.mu.
+		cloned := *w.cert
+		cloned.OCSPStaple = staple
+		w.cert = &cloned
+	}
+	w.mu.Unlock()
+
+	w.ocspMu.Lock()
+	w.ocspNextUpdate = response.NextUpdate
+	w.ocspMu.Unlock()
+
+	w.recordOCSPSuccess()
+}
+
+// findOCSPIssuer locates the certificate that issued leaf, needed to build
+// the OCSP request and validate its response. It prefers an intermediate
+// shipped alongside the leaf in CertPath, falling back to a match in the
+// configured CA bundle.
+func (w *certWatcher) findOCSPIssuer(cert *tls.Certificate, leaf *x509.Certificate) *x509.Certificate {
+	if len(cert.Certificate) > 1 {
+		if issuer, err := x509.ParseCertificate(cert.Certificate[1]); err == nil {
+			return issuer
+		}
+	}
+	for _, candidate := range parseCertificatesPEM(w.caBundle()) {
+		if bytes.Equal(candidate.RawSubject, leaf.RawIssuer) {
+			return candidate
+		}
+	}
+	return nil
+}
+
+// fetchOCSPStaple requests and validates an OCSP response for leaf from
+// responderURL, returning the raw DER bytes to staple alongside the parsed
+// response (used to schedule the next refresh).
+func fetchOCSPStaple(responderURL string, leaf, issuer *x509.Certificate) ([]byte, *ocsp.Response, error) {
+	req, err := ocsp.CreateRequest(leaf, issuer, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	httpResp, err := ocspHTTPClient.Post(responderURL, "application/ocsp-request", bytes.NewReader(req))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer httpResp.Body.Close()
+
+	body, err := io.ReadAll(httpResp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	response, err := ocsp.ParseResponseForCert(body, leaf, issuer)
+	if err != nil {
+		return nil, nil, err
+	}
+	return body, response, nil
+}
+
+// ocspRefreshInterval returns how long to wait before the next OCSP refresh
+// attempt: whichever is sooner of Options.OCSPRefreshInterval and a bit
+// ahead of the current staple's NextUpdate, so a long-lived staple still
+// gets renewed well before it expires.
+func (w *certWatcher) ocspRefreshInterval() time.Duration {
+	interval := w.opts.OCSPRefreshInterval
+	if interval <= 0 {
+		interval = defaultOCSPRefreshInterval
+	}
+
+	w.ocspMu.RLock()
+	nextUpdate := w.ocspNextUpdate
+	w.ocspMu.RUnlock()
+
+	if nextUpdate.IsZero() {
+		return interval
+	}
+	untilExpiry := time.Until(nextUpdate) - ocspRefreshJitter
+	if untilExpiry <= 0 {
+		return time.Minute
+	}
+	if untilExpiry < interval {
+		return untilExpiry
+	}
+	return interval
+}
+
+// resetTimer stops t, draining its channel if it had already fired, then
+// resets it to d. t must not be running concurrently with this call.
+func resetTimer(t *time.Timer, d time.Duration) {
+	if !t.Stop() {
+		select {
+		case <-t.C:
+		default:
+		}
+	}
+	t.Reset(d)
+}
+
+// recordOCSPSuccess increments the OCSP refresh success counter, if a
+// metrics factory was attached.
+func (w *certWatcher) recordOCSPSuccess() {
+	if w.metrics == nil {
+		return
+	}
+	w.metrics.Counter(metrics.Options{
+		Name: "tls_ocsp_refresh_success_total",
+		Tags: map[string]string{"path": w.opts.CertPath},
+	}).Inc(1)
+}
+
+// recordOCSPFailure increments the OCSP refresh failure counter, if a
+// metrics factory was attached.
+func (w *certWatcher) recordOCSPFailure() {
+	if w.metrics == nil {
+		return
+	}
+	w.metrics.Counter(metrics.Options{
+		Name: "tls_ocsp_refresh_failure_total",
+		Tags: map[string]string{"path": w.opts.CertPath},
+	}).Inc(1)
+}
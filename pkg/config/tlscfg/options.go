@@ -0,0 +1,122 @@
+// Copyright (c) 2020 The Jaeger Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tlscfg
+
+import "time"
+
+// Options describes the configuration properties for TLS servers and TLS
+// clients.
+type Options struct {
+	Enabled      bool     `mapstructure:"enabled"`
+	CAPath       string   `mapstructure:"ca"`
+	CertPath     string   `mapstructure:"cert"`
+	KeyPath      string   `mapstructure:"key"`
+	ClientCAPath string   `mapstructure:"client_ca"` // if set, client auth is required on the server
+	MinVersion   string   `mapstructure:"min_version"`
+	MaxVersion   string   `mapstructure:"max_version"`
+	CipherSuites []string `mapstructure:"cipher_suites"`
+
+	// CABundleDir, mutually exclusive with CAPath, trusts the union of every
+	// *.pem file found recursively under the directory instead of a single
+	// file. It's watched the same way as CAPath, including Kubernetes
+	// projected-volume "..data" swaps, so a new root can be added ahead of
+	// the old one being removed for zero-downtime rotation.
+	CABundleDir string `mapstructure:"ca_bundle_dir"`
+
+	// ClientCABundleDir is the ClientCAPath equivalent of CABundleDir: the
+	// union of every *.pem file under the directory is trusted for verifying
+	// client certificates, mutually exclusive with ClientCAPath.
+	ClientCABundleDir string `mapstructure:"client_ca_bundle_dir"`
+
+	// ServerName is used to verify the hostname on the returned certificates
+	// unless InsecureSkipVerify is given. It is also included in the client's
+	// handshake to support virtual hosting unless it is an IP address.
+	ServerName string `mapstructure:"server_name"`
+
+	// SkipHostVerify disables server ID verification when set to true, in
+	// which case, any certificate is accepted.
+	SkipHostVerify bool `mapstructure:"skip_host_verify"`
+
+	// ACMEEnabled switches ServerConfig.Config from the file-based
+	// certWatcher (CertPath/KeyPath) to an ACME-backed acmeCertSource that
+	// obtains and renews the server certificate automatically, e.g. via
+	// Let's Encrypt.
+	ACMEEnabled bool `mapstructure:"acme_enabled"`
+
+	// ACMEDirectoryURL is the ACME CA directory endpoint. Defaults to Let's
+	// Encrypt's production directory when empty.
+	ACMEDirectoryURL string `mapstructure:"acme_directory_url"`
+
+	// ACMEEmail is the contact address passed to the ACME CA, used for
+	// renewal and expiry notifications.
+	ACMEEmail string `mapstructure:"acme_email"`
+
+	// ACMEHostWhitelist restricts which hostnames the ACME manager will
+	// request certificates for, mirroring autocert.HostWhitelist. It must be
+	// set, since otherwise anyone who can point DNS at this process could
+	// make it request certificates on their behalf.
+	ACMEHostWhitelist []string `mapstructure:"acme_host_whitelist"`
+
+	// ACMECacheDir is the directory where obtained certificates and account
+	// keys are cached on disk, via autocert.DirCache. It is also watched for
+	// changes so that renewals performed by a sibling process sharing the
+	// same cache (e.g. in an HA deployment) show up in CertificateInfo
+	// without a restart. Handshakes are served from the certificate the
+	// autocert.Manager holds in memory, which a sibling's renewal does not
+	// replace.
+	ACMECacheDir string `mapstructure:"acme_cache_dir"`
+
+	// ExpiryWarnThreshold is how far ahead of a certificate's NotAfter the
+	// watcher starts logging "Certificate nearing expiration" warnings.
+	// Defaults to 14 days when zero.
+	ExpiryWarnThreshold time.Duration `mapstructure:"expiry_warn_threshold"`
+
+	// KeyPassphrase is the passphrase used to decrypt KeyPath when it holds
+	// an encrypted private key. Prefer KeyPassphraseFile in production, so
+	// the passphrase doesn't end up in process arguments or config dumps.
+	KeyPassphrase string `mapstructure:"key_passphrase"`
+
+	// KeyPassphraseFile, if set, is read on every reload to obtain the
+	// passphrase for KeyPath, taking precedence over KeyPassphrase. It is
+	// also watched for changes, e.g. because the KEK source rotated it.
+	KeyPassphraseFile string `mapstructure:"key_passphrase_file"`
+
+	// KeyDecryptor overrides how an encrypted KeyPath is decrypted, e.g. to
+	// source the cleartext key from an external KMS instead of decrypting
+	// locally with KeyPassphrase/KeyPassphraseFile. Defaults to decrypting
+	// PKCS#8 "ENCRYPTED PRIVATE KEY" blocks and legacy OpenSSL
+	// "Proc-Type: 4,ENCRYPTED" blocks in memory.
+	KeyDecryptor KeyDecryptor `mapstructure:"-"`
+
+	// OCSPEnabled turns on OCSP stapling for the server certificate: the
+	// watcher fetches a signed revocation status from the issuer's OCSP
+	// responder and attaches it to the TLS handshake, so clients don't have
+	// to contact the responder themselves.
+	OCSPEnabled bool `mapstructure:"ocsp_enabled"`
+
+	// OCSPResponderOverride, if set, is used instead of the responder URL
+	// published in the certificate's Authority Information Access
+	// extension.
+	OCSPResponderOverride string `mapstructure:"ocsp_responder_override"`
+
+	// OCSPRefreshInterval caps how long the watcher waits between OCSP
+	// refreshes; the actual wait is also shortened to stay ahead of the
+	// current staple's NextUpdate. Defaults to one hour when zero.
+	OCSPRefreshInterval time.Duration `mapstructure:"ocsp_refresh_interval"`
+}
+
+// DefaultExpiryWarnThreshold is used when Options.ExpiryWarnThreshold is
+// unset.
+const DefaultExpiryWarnThreshold = 14 * 24 * time.Hour
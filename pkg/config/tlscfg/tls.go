@@ -0,0 +1,310 @@
+// Copyright (c) 2020 The Jaeger Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tlscfg
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+
+	"go.uber.org/zap"
+
+	"github.com/jaegertracing/jaeger/pkg/metrics"
+)
+
+// certSource is the common contract between the file-based certWatcher and
+// the ACME-backed acmeCertSource, letting ServerConfig pick either one based
+// on Options without the rest of the TLS setup caring which is in use.
+type certSource interface {
+	certificate() *tls.Certificate
+	CertificateInfo() map[string]CertificateInfo
+	Close() error
+}
+
+// ServerConfig describes the configuration properties to connect clients
+// with a secure server, i.e. a server with TLS enabled.
+type ServerConfig struct {
+	Options `mapstructure:",squash"`
+
+	// Metrics, if set, receives certificate expiration telemetry for every
+	// certificate this server's TLS config loads.
+	Metrics metrics.Factory `mapstructure:"-"`
+
+	watcher certSource
+}
+
+// ClientConfig describes the configuration properties to connect a client
+// to a secure server.
+type ClientConfig struct {
+	Options `mapstructure:",squash"`
+
+	watcher *certWatcher
+}
+
+// Config builds a *tls.Config for a TLS server from ServerConfig. Close must
+// be called on shutdown to stop the underlying certificate watcher. When
+// Options.ACMEEnabled is set, the server
+// certificate is obtained and renewed automatically via ACME instead of
+// being loaded from CertPath/KeyPath.
+func (p *ServerConfig) Config(logger *zap.Logger) (*tls.Config, error) {
+	clientCACertPool := x509.NewCertPool()
+
+	var source certSource
+	var fileWatcher *certWatcher
+	var getCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error)
+	if p.ACMEEnabled {
+		acmeSource, err := newACMECertSource(p.Options, logger)
+		if err != nil {
+			return nil, fmt.Errorf("error loading acme tls config: %w", err)
+		}
+		go acmeSource.watchChangesLoop()
+		source = acmeSource
+		// autocert.Manager.GetCertificate must be called directly with the
+		// real *tls.ClientHelloInfo from the incoming handshake: it's what
+		// actually performs on-demand issuance and renewal, and (for
+		// TLS-ALPN-01) answers the CA's own validation probe. Routing this
+		// through the cached acmeSource.certificate() snapshot instead would
+		// mean the manager never sees real handshakes and so never issues
+		// or renews anything itself.
+		getCertificate = acmeSource.manager.GetCertificate
+	} else {
+		watcher, err := newCertWatcher(p.Options, logger)
+		if err != nil {
+			return nil, fmt.Errorf("error loading tls config: %w", err)
+		}
+		watcher.withMetrics(p.Metrics)
+		watcher.startExpiryCheckLoop(expiryCheckInterval(p.ExpiryWarnThreshold))
+		watcher.startOCSPLoop()
+		go watcher.watchChangesLoop(x509.NewCertPool(), clientCACertPool)
+		source = watcher
+		fileWatcher = watcher
+		getCertificate = func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return watcher.certificate(), nil
+		}
+	}
+	p.watcher = source
+
+	minVersionID, err := p.MinVersionID()
+	if err != nil {
+		return nil, err
+	}
+	maxVersionID, err := p.MaxVersionID()
+	if err != nil {
+		return nil, err
+	}
+	cipherSuiteIDs, err := p.CipherSuiteIDs()
+	if err != nil {
+		return nil, err
+	}
+
+	tlsCfg := &tls.Config{
+		GetCertificate: getCertificate,
+		MinVersion:     minVersionID,
+		MaxVersion:     maxVersionID,
+		CipherSuites:   cipherSuiteIDs,
+	}
+
+	switch {
+	case p.ClientCAPath != "":
+		tlsCfg.ClientCAs = clientCACertPool
+		tlsCfg.ClientAuth = tls.RequireAndVerifyClientCert
+	case p.ClientCABundleDir != "" && fileWatcher != nil:
+		// ClientCAs can't be mutated in place the way clientCACertPool is
+		// above, since the bundle directory's pool is rebuilt from scratch
+		// (and so needs to be swapped wholesale) on every reload. Rereading
+		// it via GetConfigForClient on every handshake gives each connection
+		// the live pool instead.
+		tlsCfg.ClientAuth = tls.RequireAndVerifyClientCert
+		base := tlsCfg
+		tlsCfg.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			cfg := base.Clone()
+			cfg.GetConfigForClient = nil
+			cfg.ClientCAs = fileWatcher.ClientCACertPool()
+			return cfg, nil
+		}
+	}
+
+	return tlsCfg, nil
+}
+
+// CertificateInfo returns metadata about every certificate currently in use
+// by this ServerConfig, for admin endpoints such as /tls/status to surface
+// to operators. It returns nil until Config has been called.
+func (p *ServerConfig) CertificateInfo() map[string]CertificateInfo {
+	if p.watcher == nil {
+		return nil
+	}
+	return p.watcher.CertificateInfo()
+}
+
+// Close stops the ServerConfig's certificate watcher, if one was started by
+// a call to Config.
+func (p *ServerConfig) Close() error {
+	if p.watcher != nil {
+		return p.watcher.Close()
+	}
+	return nil
+}
+
+// Config builds a *tls.Config for a TLS client from ClientConfig.
+func (p *ClientConfig) Config(logger *zap.Logger) (*tls.Config, error) {
+	certPool := x509.NewCertPool()
+
+	watcher, err := newCertWatcher(p.Options, logger)
+	if err != nil {
+		return nil, fmt.Errorf("error loading tls config: %w", err)
+	}
+	p.watcher = watcher
+	go watcher.watchChangesLoop(certPool, x509.NewCertPool())
+
+	minVersionID, err := p.MinVersionID()
+	if err != nil {
+		return nil, err
+	}
+	maxVersionID, err := p.MaxVersionID()
+	if err != nil {
+		return nil, err
+	}
+	cipherSuiteIDs, err := p.CipherSuiteIDs()
+	if err != nil {
+		return nil, err
+	}
+
+	tlsCfg := &tls.Config{
+		RootCAs:            certPool,
+		ServerName:         p.ServerName,
+		InsecureSkipVerify: p.SkipHostVerify, //nolint:gosec
+		MinVersion:         minVersionID,
+		MaxVersion:         maxVersionID,
+		CipherSuites:       cipherSuiteIDs,
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return watcher.certificate(), nil
+		},
+	}
+
+	if p.CABundleDir != "" {
+		// RootCAs is read once at dial time, so it can't track a pool that's
+		// rebuilt wholesale on every reload the way certPool is populated
+		// above via in-place AppendCertsFromPEM. Verifying manually against
+		// the live CABundleDir pool on every handshake instead lets a root
+		// rotation take effect without rebuilding tlsCfg.
+		tlsCfg.RootCAs = nil
+		tlsCfg.InsecureSkipVerify = true //nolint:gosec // verified manually below against the live CABundleDir pool
+		tlsCfg.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			return verifyPeerCertificate(rawCerts, watcher.CACertPool(), p.ServerName, p.SkipHostVerify)
+		}
+	}
+
+	return tlsCfg, nil
+}
+
+// verifyPeerCertificate re-implements the chain verification crypto/tls
+// would otherwise have done via tls.Config.RootCAs, against roots, since
+// InsecureSkipVerify had to be set to allow rootCAs to be re-read on every
+// handshake instead of being fixed at dial time. It's a no-op, like
+// InsecureSkipVerify, when skipHostVerify is set.
+func verifyPeerCertificate(rawCerts [][]byte, roots *x509.CertPool, serverName string, skipHostVerify bool) error {
+	if len(rawCerts) == 0 {
+		return errors.New("tls: no certificates presented by peer")
+	}
+
+	certs := make([]*x509.Certificate, len(rawCerts))
+	for i, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return err
+		}
+		certs[i] = cert
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+
+	opts := x509.VerifyOptions{Roots: roots, Intermediates: intermediates}
+	if !skipHostVerify {
+		opts.DNSName = serverName
+	}
+	_, err := certs[0].Verify(opts)
+	return err
+}
+
+// Close stops the ClientConfig's certificate watcher, if one was started by
+// a call to Config.
+func (p *ClientConfig) Close() error {
+	if p.watcher != nil {
+		return p.watcher.Close()
+	}
+	return nil
+}
+
+var versions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// MinVersionID resolves Options.MinVersion to its crypto/tls constant,
+// defaulting to 0 (crypto/tls picks the minimum it supports) when unset.
+func (p *Options) MinVersionID() (uint16, error) {
+	if p.MinVersion == "" {
+		return 0, nil
+	}
+	id, ok := versions[p.MinVersion]
+	if !ok {
+		return 0, fmt.Errorf("unrecognized TLS version %q", p.MinVersion)
+	}
+	return id, nil
+}
+
+// MaxVersionID resolves Options.MaxVersion to its crypto/tls constant,
+// defaulting to 0 (crypto/tls picks the maximum it supports) when unset.
+func (p *Options) MaxVersionID() (uint16, error) {
+	if p.MaxVersion == "" {
+		return 0, nil
+	}
+	id, ok := versions[p.MaxVersion]
+	if !ok {
+		return 0, fmt.Errorf("unrecognized TLS version %q", p.MaxVersion)
+	}
+	return id, nil
+}
+
+// CipherSuiteIDs resolves Options.CipherSuites (cipher suite names, as used
+// by the Go standard library) to their crypto/tls constants.
+func (p *Options) CipherSuiteIDs() ([]uint16, error) {
+	if len(p.CipherSuites) == 0 {
+		return nil, nil
+	}
+
+	ids := make([]uint16, 0, len(p.CipherSuites))
+	for _, name := range p.CipherSuites {
+		var found bool
+		for _, suite := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+			if suite.Name == name {
+				ids = append(ids, suite.ID)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("cipher suite %s not supported or doesn't exist", name)
+		}
+	}
+	return ids, nil
+}